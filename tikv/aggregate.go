@@ -0,0 +1,338 @@
+package tikv
+
+import (
+	"bytes"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/expression/aggregation"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tipb/go-tipb"
+	"golang.org/x/net/context"
+)
+
+var (
+	_ executor = &hashAggExec{}
+	_ executor = &streamAggExec{}
+)
+
+// buildAggExprs converts the pushed-down tipb.Aggregation's AggFunc list into
+// the expression/aggregation representation shared by hashAggExec and
+// streamAggExec.
+func buildAggExprs(evalCtx *evalContext, pbAggs []*tipb.Expr) ([]aggregation.Aggregation, error) {
+	aggExprs := make([]aggregation.Aggregation, 0, len(pbAggs))
+	for _, expr := range pbAggs {
+		aggExpr, err := aggregation.NewDistAggFunc(expr, evalCtx.fieldTps, evalCtx.sc)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		aggExprs = append(aggExprs, aggExpr)
+	}
+	return aggExprs, nil
+}
+
+// evalGroupByKey evaluates groupByExprs against row and returns both the
+// concatenated encoded tuple used as the aggregation state map key and the
+// per-expression encoded values used to rebuild the group-by columns of the
+// output row.
+func evalGroupByKey(groupByExprs []expression.Expression, row []types.Datum, chkRow *chkMutRow) ([]byte, [][]byte, error) {
+	// chkRow must be populated even with no GROUP BY: consume()/update()
+	// evaluate aggExprs against chkRow.row() regardless of groupByExprs
+	// being empty, and that row() call panics on chkRow's nil *MutRow if
+	// update() was never called.
+	chkRow.update(row)
+	if len(groupByExprs) == 0 {
+		return nil, nil, nil
+	}
+	key := make([]byte, 0, 32)
+	vals := make([][]byte, 0, len(groupByExprs))
+	for _, expr := range groupByExprs {
+		d, err := expr.Eval(chkRow.row())
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		b, err := codec.EncodeValue(nil, nil, d)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		key = append(key, b...)
+		vals = append(vals, b)
+	}
+	return key, vals, nil
+}
+
+// hashAggExec implements `tipb.ExecType_TypeAggregation`: it drains its
+// source executor completely, keeping one aggregation context per distinct
+// group-by tuple, and only starts emitting result rows once the source is
+// exhausted.
+type hashAggExec struct {
+	evalCtx           *evalContext
+	aggExprs          []aggregation.Aggregation
+	groupByExprs      []expression.Expression
+	relatedColOffsets []int
+	row               []types.Datum
+	chkRow            chkMutRow
+
+	aggCtxsMap   map[string][]*aggregation.AggEvaluateContext
+	groupKeys    [][]byte
+	groupKeyRows [][][]byte
+	groupCursor  int
+	executed     bool
+
+	src executor
+}
+
+func (e *hashAggExec) SetSrcExec(exec executor) {
+	e.src = exec
+}
+
+func (e *hashAggExec) GetSrcExec() executor {
+	return e.src
+}
+
+func (e *hashAggExec) ResetCounts() {
+	e.src.ResetCounts()
+}
+
+func (e *hashAggExec) Counts() []int64 {
+	return e.src.Counts()
+}
+
+func (e *hashAggExec) Cursor() ([]byte, bool) {
+	panic("don't not use coprocessor streaming API for hash aggregation!")
+}
+
+// NextBatch has no cheaper batched strategy than draining groups one at a
+// time, so it just wraps Next().
+func (e *hashAggExec) NextBatch(ctx context.Context, chk *chunk.Chunk) error {
+	return defaultNextBatch(ctx, e, chk)
+}
+
+func (e *hashAggExec) consume(value [][]byte) error {
+	if e.aggCtxsMap == nil {
+		e.aggCtxsMap = make(map[string][]*aggregation.AggEvaluateContext)
+	}
+	err := e.evalCtx.decodeRelatedColumnVals(e.relatedColOffsets, value, e.row)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	groupKey, groupVals, err := evalGroupByKey(e.groupByExprs, e.row, &e.chkRow)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	aggCtxs, ok := e.aggCtxsMap[string(groupKey)]
+	if !ok {
+		aggCtxs = make([]*aggregation.AggEvaluateContext, 0, len(e.aggExprs))
+		for _, agg := range e.aggExprs {
+			aggCtxs = append(aggCtxs, agg.CreateContext(e.evalCtx.sc))
+		}
+		e.aggCtxsMap[string(groupKey)] = aggCtxs
+		e.groupKeys = append(e.groupKeys, groupKey)
+		e.groupKeyRows = append(e.groupKeyRows, groupVals)
+	}
+	for i, agg := range e.aggExprs {
+		if err = agg.Update(aggCtxs[i], e.evalCtx.sc, e.chkRow.row()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// spill encodes the finished aggregation state of the group at idx into a
+// coprocessor result row: every partial-result value of each agg function
+// (some, like AVG, have more than one) followed by the group-by column
+// values.
+func (e *hashAggExec) spill(idx int) ([][]byte, error) {
+	aggCtxs := e.aggCtxsMap[string(e.groupKeys[idx])]
+	row := make([][]byte, 0, len(e.aggExprs)+len(e.groupByExprs))
+	for i, agg := range e.aggExprs {
+		for _, d := range agg.GetPartialResult(aggCtxs[i]) {
+			b, err := codec.EncodeValue(nil, nil, d)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			row = append(row, b)
+		}
+	}
+	row = append(row, e.groupKeyRows[idx]...)
+	return row, nil
+}
+
+// seedEmptyGroup gives a group-by-less aggregation (e.g. a bare COUNT(*))
+// its one mandatory result row even when the source produced no rows at
+// all: SQL semantics say COUNT(*) over zero rows is 0, not "no rows", so
+// consume() never getting called must not leave aggCtxsMap empty.
+func (e *hashAggExec) seedEmptyGroup() {
+	if len(e.groupByExprs) != 0 || e.aggCtxsMap != nil {
+		return
+	}
+	e.aggCtxsMap = make(map[string][]*aggregation.AggEvaluateContext)
+	aggCtxs := make([]*aggregation.AggEvaluateContext, 0, len(e.aggExprs))
+	for _, agg := range e.aggExprs {
+		aggCtxs = append(aggCtxs, agg.CreateContext(e.evalCtx.sc))
+	}
+	e.aggCtxsMap[""] = aggCtxs
+	e.groupKeys = append(e.groupKeys, nil)
+	e.groupKeyRows = append(e.groupKeyRows, nil)
+}
+
+func (e *hashAggExec) Next(ctx context.Context) ([][]byte, error) {
+	if !e.executed {
+		for {
+			value, err := e.src.Next(ctx)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if value == nil {
+				break
+			}
+			if err = e.consume(value); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		e.seedEmptyGroup()
+		e.executed = true
+	}
+	if e.groupCursor >= len(e.groupKeys) {
+		return nil, nil
+	}
+	row, err := e.spill(e.groupCursor)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	e.groupCursor++
+	return row, nil
+}
+
+// streamAggExec implements `tipb.ExecType_TypeStreamAgg`. Unlike hashAggExec
+// it assumes rows arrive already sorted on the group-by columns (typically
+// fed by an index scan), so it only ever needs to hold one group's
+// aggregation context at a time, flushing a result row as soon as the
+// group-by key changes.
+type streamAggExec struct {
+	evalCtx           *evalContext
+	aggExprs          []aggregation.Aggregation
+	groupByExprs      []expression.Expression
+	relatedColOffsets []int
+	row               []types.Datum
+	chkRow            chkMutRow
+
+	aggCtxs      []*aggregation.AggEvaluateContext
+	currGroupKey []byte
+	currGroupRow [][]byte
+	hasGroup     bool
+	executed     bool
+
+	src executor
+}
+
+func (e *streamAggExec) SetSrcExec(exec executor) {
+	e.src = exec
+}
+
+func (e *streamAggExec) GetSrcExec() executor {
+	return e.src
+}
+
+func (e *streamAggExec) ResetCounts() {
+	e.src.ResetCounts()
+}
+
+func (e *streamAggExec) Counts() []int64 {
+	return e.src.Counts()
+}
+
+func (e *streamAggExec) Cursor() ([]byte, bool) {
+	panic("don't not use coprocessor streaming API for stream aggregation!")
+}
+
+// NextBatch has no cheaper batched strategy than flushing groups one at a
+// time, so it just wraps Next().
+func (e *streamAggExec) NextBatch(ctx context.Context, chk *chunk.Chunk) error {
+	return defaultNextBatch(ctx, e, chk)
+}
+
+func (e *streamAggExec) newGroup(groupKey []byte, groupVals [][]byte) {
+	e.currGroupKey = groupKey
+	e.currGroupRow = groupVals
+	e.hasGroup = true
+	e.aggCtxs = make([]*aggregation.AggEvaluateContext, 0, len(e.aggExprs))
+	for _, agg := range e.aggExprs {
+		e.aggCtxs = append(e.aggCtxs, agg.CreateContext(e.evalCtx.sc))
+	}
+}
+
+func (e *streamAggExec) update() error {
+	for i, agg := range e.aggExprs {
+		if err := agg.Update(e.aggCtxs[i], e.evalCtx.sc, e.chkRow.row()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (e *streamAggExec) spill() ([][]byte, error) {
+	row := make([][]byte, 0, len(e.aggExprs)+len(e.groupByExprs))
+	for i, agg := range e.aggExprs {
+		for _, d := range agg.GetPartialResult(e.aggCtxs[i]) {
+			b, err := codec.EncodeValue(nil, nil, d)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			row = append(row, b)
+		}
+	}
+	row = append(row, e.currGroupRow...)
+	return row, nil
+}
+
+func (e *streamAggExec) Next(ctx context.Context) ([][]byte, error) {
+	if e.executed {
+		return nil, nil
+	}
+	for {
+		value, err := e.src.Next(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if value == nil {
+			e.executed = true
+			if !e.hasGroup {
+				// A group-by-less aggregation (e.g. a bare COUNT(*)) still
+				// owes SQL its one mandatory result row even when the
+				// source produced nothing: seed the zero-state group
+				// newGroup would otherwise only create on the first row.
+				if len(e.groupByExprs) != 0 {
+					return nil, nil
+				}
+				e.newGroup(nil, nil)
+			}
+			return e.spill()
+		}
+		if err = e.evalCtx.decodeRelatedColumnVals(e.relatedColOffsets, value, e.row); err != nil {
+			return nil, errors.Trace(err)
+		}
+		groupKey, groupVals, err := evalGroupByKey(e.groupByExprs, e.row, &e.chkRow)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !e.hasGroup {
+			e.newGroup(groupKey, groupVals)
+		} else if !bytes.Equal(e.currGroupKey, groupKey) {
+			row, err := e.spill()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			e.newGroup(groupKey, groupVals)
+			if err = e.update(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			return row, nil
+		}
+		if err = e.update(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
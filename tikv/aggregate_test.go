@@ -0,0 +1,105 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/expression/aggregation"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// countStarAggExprs builds the aggExprs list for a single pushed-down
+// COUNT(*): a tipb.Expr with no children is how the coprocessor protocol
+// represents COUNT(*) rather than COUNT(<col>).
+func countStarAggExprs(t *testing.T, evalCtx *evalContext) []aggregation.Aggregation {
+	aggExprs, err := buildAggExprs(evalCtx, []*tipb.Expr{{Tp: tipb.ExprType_Count}})
+	require.NoError(t, err)
+	return aggExprs
+}
+
+func decodeCount(t *testing.T, encoded []byte) int64 {
+	_, d, err := codec.DecodeOne(encoded)
+	require.NoError(t, err)
+	return d.GetInt64()
+}
+
+func TestEvalGroupByKey(t *testing.T) {
+	groupByExprs := []expression.Expression{
+		&expression.Constant{Value: types.NewIntDatum(1)},
+		&expression.Constant{Value: types.NewStringDatum("a")},
+	}
+	var chkRow chkMutRow
+	key1, vals1, err := evalGroupByKey(groupByExprs, []types.Datum{}, &chkRow)
+	require.NoError(t, err)
+	require.Len(t, vals1, 2)
+
+	key2, _, err := evalGroupByKey(groupByExprs, []types.Datum{}, &chkRow)
+	require.NoError(t, err)
+	require.Equal(t, key1, key2, "identical group-by values must hash to the same key")
+
+	otherExprs := []expression.Expression{
+		&expression.Constant{Value: types.NewIntDatum(2)},
+		&expression.Constant{Value: types.NewStringDatum("a")},
+	}
+	key3, _, err := evalGroupByKey(otherExprs, []types.Datum{}, &chkRow)
+	require.NoError(t, err)
+	require.NotEqual(t, key1, key3, "different group-by values must hash to different keys")
+}
+
+func TestHashAggExecNextEmitsOneRowForZeroSourceRows(t *testing.T) {
+	evalCtx := &evalContext{sc: &stmtctx.StatementContext{}}
+	e := &hashAggExec{
+		evalCtx:  evalCtx,
+		aggExprs: countStarAggExprs(t, evalCtx),
+		row:      []types.Datum{},
+		src:      &fakeRowExec{},
+	}
+
+	row, err := e.Next(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, row, "COUNT(*) over zero source rows must still emit its one mandatory row")
+	require.EqualValues(t, 0, decodeCount(t, row[0]))
+
+	row, err = e.Next(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, row, "the single zero-row group must not be emitted twice")
+}
+
+func TestHashAggExecConsumeFirstGroupDoesNotPanicOnNilMap(t *testing.T) {
+	evalCtx := &evalContext{sc: &stmtctx.StatementContext{}}
+	e := &hashAggExec{
+		evalCtx:  evalCtx,
+		aggExprs: countStarAggExprs(t, evalCtx),
+		row:      []types.Datum{},
+	}
+
+	require.Nil(t, e.aggCtxsMap, "aggCtxsMap must start out nil, the exact state that used to panic")
+	require.NotPanics(t, func() {
+		require.NoError(t, e.consume(nil))
+	})
+	require.Len(t, e.aggCtxsMap, 1, "the first consume call must lazily create the group's context")
+}
+
+func TestStreamAggExecNextEmitsOneRowForZeroSourceRows(t *testing.T) {
+	evalCtx := &evalContext{sc: &stmtctx.StatementContext{}}
+	e := &streamAggExec{
+		evalCtx:  evalCtx,
+		aggExprs: countStarAggExprs(t, evalCtx),
+		row:      []types.Datum{},
+		src:      &fakeRowExec{},
+	}
+
+	row, err := e.Next(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, row, "COUNT(*) over zero source rows must still emit its one mandatory row")
+	require.EqualValues(t, 0, decodeCount(t, row[0]))
+
+	row, err = e.Next(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, row, "a streamAggExec that already flushed its one group must not emit again")
+}
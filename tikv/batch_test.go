@@ -0,0 +1,58 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeRowExec is a minimal executor stub that hands out a fixed set of
+// pre-encoded rows, one NextBatch call at a time, so limitExec.NextBatch can
+// be exercised without a real DB reader.
+type fakeRowExec struct {
+	rows [][][]byte
+}
+
+func (f *fakeRowExec) SetSrcExec(executor)    {}
+func (f *fakeRowExec) GetSrcExec() executor   { return nil }
+func (f *fakeRowExec) ResetCounts()           {}
+func (f *fakeRowExec) Counts() []int64        { return nil }
+func (f *fakeRowExec) Cursor() ([]byte, bool) { return nil, false }
+func (f *fakeRowExec) Next(ctx context.Context) ([][]byte, error) {
+	if len(f.rows) == 0 {
+		return nil, nil
+	}
+	row := f.rows[0]
+	f.rows = f.rows[1:]
+	return row, nil
+}
+func (f *fakeRowExec) NextBatch(ctx context.Context, chk *chunk.Chunk) error {
+	return defaultNextBatch(ctx, f, chk)
+}
+
+func encodedIntRow(t *testing.T, v int64) [][]byte {
+	b, err := codec.EncodeValue(nil, nil, types.NewIntDatum(v))
+	require.NoError(t, err)
+	return [][]byte{b}
+}
+
+func TestLimitExecNextBatchTruncatesToRemainingLimit(t *testing.T) {
+	src := &fakeRowExec{rows: [][][]byte{
+		encodedIntRow(t, 1),
+		encodedIntRow(t, 2),
+		encodedIntRow(t, 3),
+	}}
+	e := &limitExec{limit: 2, src: src}
+	chk := chunk.NewChunkWithCapacity([]*types.FieldType{types.NewFieldType(mysql.TypeLonglong)}, 8)
+
+	require.NoError(t, e.NextBatch(context.Background(), chk))
+	require.Equal(t, 2, chk.NumRows(), "NextBatch must not hand back more rows than the configured limit")
+
+	require.NoError(t, e.NextBatch(context.Background(), chk))
+	require.Equal(t, 2, chk.NumRows(), "a limitExec that already reached its limit must not pull any more rows")
+}
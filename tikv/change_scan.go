@@ -0,0 +1,363 @@
+package tikv
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tipb/go-tipb"
+	"golang.org/x/net/context"
+)
+
+var _ executor = &changeScanExec{}
+
+// Change-feed op types, reported in the extra op-type column changeScanExec
+// appends to every row so callers can tell a deletion from an update
+// without re-reading the current value.
+const (
+	OpTypePut byte = iota
+	OpTypeDelete
+	OpTypeRollback
+)
+
+// changeScanBatch bounds how many mutations ChangeScan walks per fillRows
+// call, mirroring the scanLimit batching tableScanExec/indexScanExec already
+// use for their range scans.
+const changeScanBatch = scanLimit
+
+// errChangeScanBatchDone is returned by the ChangeScan callback to stop the
+// walk once changeScanBatch rows have been collected; it is not a real
+// error and is swallowed by fillRows.
+var errChangeScanBatchDone = errors.New("change scan batch done")
+
+// ChangeScan walks the write CF for [startKey, endKey) and invokes fn for
+// every committed mutation whose commit_ts falls in (startTS, endTS],
+// including deletes and rollbacks, so callers can pull an incremental
+// snapshot between two TSOs without a full table scan.
+func (store *MVCCStore) ChangeScan(startTS, endTS uint64, startKey, endKey []byte, fn func(key, value []byte, commitTS uint64, opType byte) error) error {
+	return store.db.View(func(reader *DBReader) error {
+		return reader.ScanWriteCF(startKey, endKey, func(key, value []byte, commitTS uint64, writeType byte) error {
+			if commitTS <= startTS || commitTS > endTS {
+				return nil
+			}
+			var opType byte
+			switch writeType {
+			case WriteTypeDelete:
+				opType = OpTypeDelete
+			case WriteTypeRollback:
+				opType = OpTypeRollback
+			default:
+				opType = OpTypePut
+			}
+			return fn(key, value, commitTS, opType)
+		})
+	})
+}
+
+// OldestLockTS is the CheckRangeLock-equivalent guard for change scans: it
+// reports the startTS of the oldest lock still outstanding in [startKey,
+// endKey), so the caller knows how far it can safely advance its checkpoint
+// without risking a mutation that commits behind it. ok is false when the
+// range is lock-free.
+func (store *MVCCStore) OldestLockTS(startKey, endKey []byte) (ts uint64, ok bool, err error) {
+	err = store.db.View(func(reader *DBReader) error {
+		return reader.ScanLockCF(startKey, endKey, func(key []byte, lock *Lock) error {
+			if !ok || lock.StartTS < ts {
+				ts = lock.StartTS
+				ok = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	return ts, ok, nil
+}
+
+// changeScanExec wraps MVCCStore.ChangeScan so a change-feed request can be
+// pulled through the normal executor tree: each result row is the usual
+// decoded table/index row augmented with a commit-ts and an op-type column.
+type changeScanExec struct {
+	mvccStore *MVCCStore
+	reqCtx    *requestCtx
+
+	startTS  uint64
+	endTS    uint64
+	startKey []byte
+	endKey   []byte
+	seekKey  []byte
+
+	isIndex  bool
+	colsLen  int
+	pkStatus int
+	columns  []*tipb.ColumnInfo
+	colIDs   map[int64]int
+
+	lockChecked bool
+	rowCursor   int
+	rows        [][][]byte
+	done        bool
+
+	src executor
+}
+
+func (e *changeScanExec) SetSrcExec(exec executor) {
+	e.src = exec
+}
+
+func (e *changeScanExec) GetSrcExec() executor {
+	return e.src
+}
+
+func (e *changeScanExec) ResetCounts() {}
+
+func (e *changeScanExec) Counts() []int64 {
+	return nil
+}
+
+func (e *changeScanExec) Cursor() ([]byte, bool) {
+	panic("don't not use coprocessor streaming API for change scan!")
+}
+
+// checkRangeLock guards against streaming a change scan past a still
+// outstanding lock: a prewritten-but-not-yet-committed mutation in
+// [startKey, endKey) might later commit with a commit_ts inside
+// (startTS, endTS], which this scan would then have missed. It mirrors
+// tableScanExec/indexScanExec's checkRangeLock, except it reports the
+// oldest lock's startTS via OldestLockTS so the caller learns exactly how
+// far it can safely advance its checkpoint instead of just being denied.
+func (e *changeScanExec) checkRangeLock() error {
+	if e.lockChecked {
+		return nil
+	}
+	ts, ok, err := e.mvccStore.OldestLockTS(e.startKey, e.endKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if ok && ts <= e.endTS {
+		return errors.Errorf("change scan range has an outstanding lock at startTS %d, cannot safely advance checkpoint past it", ts)
+	}
+	e.lockChecked = true
+	return nil
+}
+
+// nullRow builds a colsLen-wide row with every column set to the encoded
+// SQL NULL, the shape decodeTombstoneRow falls back to when it can't
+// reconstruct a handle from the key.
+func nullRow(colsLen int) [][]byte {
+	row := make([][]byte, colsLen)
+	for i := range row {
+		row[i] = []byte{codec.NilFlag}
+	}
+	return row
+}
+
+// decodeTombstoneRow builds the row for a delete/rollback write-CF record,
+// which carries no column data. It gives the row the exact same shape a
+// OpTypePut row for the same key would have (e.colsLen entries, one per
+// pushed-down column) rather than a bespoke one-column layout, so a
+// consumer decoding a fixed colsLen+2 datums per row off the flat RowsData
+// stream runExec produces doesn't desync the moment a tombstone appears:
+// the PK/handle column is reconstructed directly from the key and every
+// other column is NULL, since a deleted or rolled-back row has no other
+// column values left to report. It deliberately does not call
+// getRowData/decodeIndexRow's value-decoding paths: a tombstone's value is
+// never a real row/index value (a table-scan tombstone's value is nil), and
+// getRowData in particular is never exercised against a nil value anywhere
+// else in this codebase (tableScanExec.fillRowsFromPoint special-cases
+// len(val) == 0 before ever reaching it).
+func (e *changeScanExec) decodeTombstoneRow(key, value []byte) ([][]byte, error) {
+	if e.isIndex {
+		// The index key embeds the handle unless the index is unique and
+		// none of the indexed values is NULL; decodeIndexRow already
+		// reconstructs it from the key in that case and only falls back
+		// to the (absent, for a tombstone) value otherwise, so try it
+		// first and only null-fill if it can't recover a handle.
+		if row, err := decodeIndexRow(key, value, e.colsLen, e.pkStatus); err == nil {
+			return row, nil
+		}
+		return nullRow(e.colsLen), nil
+	}
+	handle, err := decodeRowKey(key)
+	if err != nil {
+		return nullRow(e.colsLen), nil
+	}
+	row := nullRow(e.colsLen)
+	for _, col := range e.columns {
+		if !col.GetPkHandle() && col.GetColumnId() != model.ExtraHandleID {
+			continue
+		}
+		offset, ok := e.colIDs[col.GetColumnId()]
+		if !ok {
+			continue
+		}
+		var handleDatum types.Datum
+		if mysql.HasUnsignedFlag(uint(col.GetFlag())) {
+			handleDatum = types.NewUintDatum(uint64(handle))
+		} else {
+			handleDatum = types.NewIntDatum(handle)
+		}
+		handleBytes, err := codec.EncodeValue(nil, nil, handleDatum)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		row[offset] = handleBytes
+	}
+	return row, nil
+}
+
+// decodeChangeRow decodes the mutation's key/value into the usual row
+// columns and appends the commit-ts and op-type extra columns. Only
+// OpTypePut carries a post-image to decode; a delete or rollback write-CF
+// record has no column data at all, so those go through
+// decodeTombstoneRow instead of getRowData/decodeIndexRow.
+func (e *changeScanExec) decodeChangeRow(key, value []byte, commitTS uint64, opType byte) ([][]byte, error) {
+	var row [][]byte
+	var err error
+	switch opType {
+	case OpTypePut:
+		if e.isIndex {
+			row, err = decodeIndexRow(key, value, e.colsLen, e.pkStatus)
+		} else {
+			var handle int64
+			handle, err = decodeRowKey(key)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			row, err = getRowData(e.columns, e.colIDs, handle, value)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	case OpTypeDelete, OpTypeRollback:
+		row, err = e.decodeTombstoneRow(key, value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	default:
+		return nil, errors.Errorf("decodeChangeRow: unknown op type %d", opType)
+	}
+	commitTSBytes, err := codec.EncodeValue(nil, nil, types.NewUintDatum(commitTS))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	opTypeBytes, err := codec.EncodeValue(nil, nil, types.NewUintDatum(uint64(opType)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(row, commitTSBytes, opTypeBytes), nil
+}
+
+func (e *changeScanExec) fillRows() error {
+	if e.done {
+		return nil
+	}
+	count := 0
+	var lastKey []byte
+	err := e.mvccStore.ChangeScan(e.startTS, e.endTS, e.seekKey, e.endKey, func(key, value []byte, commitTS uint64, opType byte) error {
+		if count >= changeScanBatch {
+			return errChangeScanBatchDone
+		}
+		row, err := e.decodeChangeRow(safeCopy(key), safeCopy(value), commitTS, opType)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		e.rows = append(e.rows, row)
+		lastKey = key
+		count++
+		return nil
+	})
+	if err != nil && err != errChangeScanBatchDone {
+		return errors.Trace(err)
+	}
+	if count < changeScanBatch {
+		e.done = true
+		return nil
+	}
+	e.seekKey = []byte(kv.Key(lastKey).PrefixNext())
+	return nil
+}
+
+func (e *changeScanExec) Next(ctx context.Context) ([][]byte, error) {
+	if err := e.checkRangeLock(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for {
+		if e.rowCursor < len(e.rows) {
+			row := e.rows[e.rowCursor]
+			e.rowCursor++
+			return row, nil
+		}
+		e.rowCursor = 0
+		e.rows = e.rows[:0]
+		if err := e.fillRows(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(e.rows) == 0 {
+			return nil, nil
+		}
+	}
+}
+
+// NextBatch has no cheaper batched strategy than draining the change log one
+// fillRows() batch at a time, so it just wraps Next().
+func (e *changeScanExec) NextBatch(ctx context.Context, chk *chunk.Chunk) error {
+	return defaultNextBatch(ctx, e, chk)
+}
+
+// reqTypeChangeScan is a unistore-local coprocessor.Request.Tp for
+// changeScanExec, handled by handleCopRequest alongside kv.ReqTypeDAG.
+// There is no kvrpcpb.ChangeScanRequest message yet, so changeScanRequest
+// below is a placeholder wire format (gob-encoded into the request's Data)
+// standing in for one; swap it for a real protobuf message once one lands.
+const reqTypeChangeScan int64 = 1001
+
+// changeScanRequest is the changeScanExec-specific payload carried in
+// coprocessor.Request.Data for reqTypeChangeScan.
+type changeScanRequest struct {
+	StartTS  uint64
+	EndTS    uint64
+	StartKey []byte
+	EndKey   []byte
+	IsIndex  bool
+	ColsLen  int
+	PkStatus int
+	Columns  []*tipb.ColumnInfo
+}
+
+// handleChangeScanRequest decodes a reqTypeChangeScan request, builds a
+// changeScanExec for it and drains it into a coprocessor.Response the same
+// way handleCopDAGRequest drains the generic executor tree.
+func handleChangeScanRequest(reqCtx *requestCtx, req *coprocessor.Request) (*coprocessor.Response, error) {
+	var csReq changeScanRequest
+	if err := gob.NewDecoder(bytes.NewReader(req.GetData())).Decode(&csReq); err != nil {
+		return nil, errors.Trace(err)
+	}
+	colIDs := make(map[int64]int, len(csReq.Columns))
+	for i, col := range csReq.Columns {
+		colIDs[col.GetColumnId()] = i
+	}
+	exec := &changeScanExec{
+		mvccStore: reqCtx.mvccStore,
+		reqCtx:    reqCtx,
+		startTS:   csReq.StartTS,
+		endTS:     csReq.EndTS,
+		startKey:  csReq.StartKey,
+		endKey:    csReq.EndKey,
+		seekKey:   csReq.StartKey,
+		isIndex:   csReq.IsIndex,
+		colsLen:   csReq.ColsLen,
+		pkStatus:  csReq.PkStatus,
+		columns:   csReq.Columns,
+		colIDs:    colIDs,
+	}
+	return runExec(exec)
+}
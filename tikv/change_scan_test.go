@@ -0,0 +1,39 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeChangeRowTombstoneMatchesPutRowShape(t *testing.T) {
+	e := &changeScanExec{colsLen: 2}
+	key := []byte("not-a-real-row-key")
+
+	for _, opType := range []byte{OpTypeDelete, OpTypeRollback} {
+		row, err := e.decodeChangeRow(key, nil, 42, opType)
+		require.NoError(t, err)
+		require.Len(t, row, e.colsLen+2, "a tombstone row must have the same colsLen+2 shape as a put row, or every row after it in the chunk desyncs")
+
+		for i := 0; i < e.colsLen; i++ {
+			_, d, err := codec.DecodeOne(row[i])
+			require.NoError(t, err)
+			require.True(t, d.IsNull(), "a deleted/rolled-back row has no surviving column data to report")
+		}
+
+		_, gotCommitTS, err := codec.DecodeOne(row[e.colsLen])
+		require.NoError(t, err)
+		require.EqualValues(t, 42, gotCommitTS.GetUint64())
+
+		_, gotOpType, err := codec.DecodeOne(row[e.colsLen+1])
+		require.NoError(t, err)
+		require.EqualValues(t, opType, gotOpType.GetUint64())
+	}
+}
+
+func TestDecodeChangeRowUnknownOpType(t *testing.T) {
+	e := &changeScanExec{}
+	_, err := e.decodeChangeRow([]byte("k"), nil, 1, 255)
+	require.Error(t, err, "an unrecognized op type must not be silently treated as a put")
+}
@@ -0,0 +1,327 @@
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// closureExec is a fused fast path for the two most common DAG shapes seen
+// on the OLTP hot path:
+//
+//	(a) a bare {TableScan/IndexScan}, projecting the scan's column list
+//	(b) {TableScan/IndexScan} -> Selection -> Limit, where either the
+//	    Selection or the Limit may be absent
+//
+// Instead of walking a tree of executor.Next() calls that each allocate and
+// copy a [][]byte per row, closureExec opens the DB reader once and decodes,
+// filters and limits rows in a single tight loop, writing results straight
+// into the response chunk. tryBuildClosureExecutor reports whether a given
+// DAGRequest matches one of these shapes; handleCopDAGRequest falls back to
+// the generic executor tree when it doesn't.
+type closureExec struct {
+	reqCtx         *requestCtx
+	kvRanges       []kv.KeyRange
+	startTS        uint64
+	isolationLevel kvrpcpb.IsolationLevel
+	ignoreLock     bool
+	lockChecked    bool
+
+	evalCtx           *evalContext
+	colIDs            map[int64]int
+	columns           []*tipb.ColumnInfo
+	conditions        []expression.Expression
+	relatedColOffsets []int
+	limit             int64
+
+	// isIndex, colsLen and pkStatus mirror indexScanExec's fields and
+	// select decodeIndexRow over the table-row decodeRowKey+getRowData
+	// path in processRow; they're unused when the scan leaf is a
+	// TableScan.
+	isIndex  bool
+	colsLen  int
+	pkStatus int
+
+	// encodeType mirrors handleCopDAGRequest's generic-path choice between
+	// runExecBatch and runExec: only a client that advertised
+	// EncodeType_TypeChunk gets a chunk-encoded response out of
+	// runClosureExec, everyone else gets the row-oriented rows collector
+	// below instead of a response they can't decode.
+	encodeType tipb.EncodeType
+
+	row    []types.Datum
+	chkRow chkMutRow
+
+	rowCount int
+	chk      *chunk.Chunk
+	rows     [][][]byte
+}
+
+// tryBuildClosureExecutor inspects the incoming DAGRequest and returns a
+// closureExec when its shape is one of the whitelisted fast paths, or nil if
+// the generic executor tree needs to handle it (e.g. topN, aggregation, a
+// descending scan, or anything with more than a scan/selection/limit).
+// colIDs, columns, kvRanges and evalCtx are the same scan-node setup
+// buildExec already derives before constructing
+// tableScanExec/indexScanExec; the caller passes them in rather than this
+// function recomputing them.
+func tryBuildClosureExecutor(reqCtx *requestCtx, dagReq *tipb.DAGRequest, evalCtx *evalContext, colIDs map[int64]int, columns []*tipb.ColumnInfo, kvRanges []kv.KeyRange) (*closureExec, error) {
+	execs := dagReq.Executors
+	if len(execs) == 0 || len(execs) > 3 {
+		return nil, nil
+	}
+	scan := execs[0]
+	switch scan.Tp {
+	case tipb.ExecType_TypeTableScan:
+		if scan.TblScan.GetDesc() {
+			return nil, nil
+		}
+	case tipb.ExecType_TypeIndexScan:
+		if scan.IdxScan.GetDesc() {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	for _, exec := range execs[1:] {
+		switch exec.Tp {
+		case tipb.ExecType_TypeSelection, tipb.ExecType_TypeLimit:
+		default:
+			return nil, nil
+		}
+	}
+
+	e := &closureExec{
+		reqCtx:         reqCtx,
+		kvRanges:       kvRanges,
+		startTS:        dagReq.GetStartTs(),
+		isolationLevel: reqCtx.isolationLevel,
+		ignoreLock:     reqCtx.ignoreLock,
+		evalCtx:        evalCtx,
+		colIDs:         colIDs,
+		columns:        columns,
+		limit:          -1,
+		encodeType:     dagReq.GetEncodeType(),
+	}
+	if scan.Tp == tipb.ExecType_TypeIndexScan {
+		e.isIndex = true
+		e.colsLen = len(columns)
+		e.pkStatus = pkColNotExists
+		for _, col := range columns {
+			if col.GetPkHandle() {
+				if mysql.HasUnsignedFlag(uint(col.GetFlag())) {
+					e.pkStatus = pkColIsUnsigned
+				} else {
+					e.pkStatus = pkColIsSigned
+				}
+			}
+		}
+	}
+	var err error
+	for _, exec := range execs[1:] {
+		switch exec.Tp {
+		case tipb.ExecType_TypeSelection:
+			if e.conditions != nil || e.limit >= 0 {
+				return nil, nil
+			}
+			e.conditions, err = convertToExprs(e.evalCtx.sc, e.evalCtx.fieldTps, exec.Selection.Conditions)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			e.relatedColOffsets, err = extractOffsetsInColumnInfo(e.columns, e.conditions)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		case tipb.ExecType_TypeLimit:
+			if e.limit >= 0 {
+				return nil, nil
+			}
+			e.limit = int64(exec.Limit.GetLimit())
+		}
+	}
+	e.row = make([]types.Datum, len(e.columns))
+	return e, nil
+}
+
+// matchRow decodes the row, evaluates the pushed-down filters against it and
+// reports whether it survives. It reuses e.row / e.chkRow across calls to
+// avoid a per-row allocation.
+func (e *closureExec) matchRow(value [][]byte) (bool, error) {
+	if len(e.conditions) == 0 {
+		return true, nil
+	}
+	if err := e.evalCtx.decodeRelatedColumnVals(e.relatedColOffsets, value, e.row); err != nil {
+		return false, errors.Trace(err)
+	}
+	e.chkRow.update(e.row)
+	for _, cond := range e.conditions {
+		d, err := cond.Eval(e.chkRow.row())
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if d.IsNull() {
+			return false, nil
+		}
+		b, err := d.ToBool(e.evalCtx.sc)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if b == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// done reports whether the configured limit has already been reached.
+func (e *closureExec) done() bool {
+	return e.limit >= 0 && int64(e.rowCount) >= e.limit
+}
+
+// processRow decodes a single scanned (key, value) pair, applies the
+// pushed-down filter and, if the row survives, writes it into e.chk. It is
+// the per-row body shared by the point-get and range-scan loops below.
+// Index scans decode via decodeIndexRow the same way indexScanExec does;
+// table scans decode the handle out of the key and fall back to
+// getRowData, same as tableScanExec.
+func (e *closureExec) processRow(key, value []byte) error {
+	var row [][]byte
+	var err error
+	if e.isIndex {
+		row, err = decodeIndexRow(key, value, e.colsLen, e.pkStatus)
+	} else {
+		var handle int64
+		handle, err = decodeRowKey(key)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		row, err = getRowData(e.columns, e.colIDs, handle, value)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	matched, err := e.matchRow(row)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !matched {
+		return nil
+	}
+	if e.encodeType == tipb.EncodeType_TypeChunk {
+		for i, col := range e.columns {
+			if err = appendColValToChunk(e.chk, i, row, col); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	} else {
+		e.rows = append(e.rows, row)
+	}
+	e.rowCount++
+	return nil
+}
+
+// appendColValToChunk decodes the already-encoded column value at colIdx and
+// appends it to chk, avoiding the intermediate []types.Datum row that the
+// generic executor tree builds for every row.
+func appendColValToChunk(chk *chunk.Chunk, colIdx int, row [][]byte, col *tipb.ColumnInfo) error {
+	_, d, err := codec.DecodeOne(row[colIdx])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	chk.AppendDatum(colIdx, &d)
+	return nil
+}
+
+// checkRangeLock guards e.kvRanges the same way
+// tableScanExec/indexScanExec's checkRangeLock does: an outstanding lock in
+// a range this request is about to read must fail the request rather than
+// be silently served, unless the caller opted into ignoreLock.
+func (e *closureExec) checkRangeLock() error {
+	if !e.ignoreLock && !e.lockChecked {
+		for _, ran := range e.kvRanges {
+			if err := e.reqCtx.mvccStore.CheckRangeLock(e.startTS, ran.StartKey, ran.EndKey); err != nil {
+				return err
+			}
+		}
+		e.lockChecked = true
+	}
+	return nil
+}
+
+// process opens the DB reader once and iterates the kv ranges directly,
+// bypassing the generic executor tree entirely, writing matched rows into
+// chk. tryBuildClosureExecutor never sets e.chk itself since the same
+// closureExec could in principle be drained into more than one destination
+// chunk, so the caller always passes it in here.
+func (e *closureExec) process(chk *chunk.Chunk) error {
+	if err := e.checkRangeLock(); err != nil {
+		return errors.Trace(err)
+	}
+	e.chk = chk
+	reader := e.reqCtx.getDBReader()
+	for _, ran := range e.kvRanges {
+		if e.done() {
+			break
+		}
+		if ran.IsPoint() {
+			val, err := reader.Get(ran.StartKey, e.startTS)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(val) == 0 {
+				continue
+			}
+			if err = e.processRow(ran.StartKey, safeCopy(val)); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		if err := e.processRange(reader, ran); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// processRange scans ran in scanLimit-sized batches, re-seeking from the
+// last key scanned each time, until the range is exhausted or e.limit is
+// reached. A single reader.Scan call only ever returns up to scanLimit
+// rows, so without this loop any range bigger than scanLimit would be
+// silently truncated.
+func (e *closureExec) processRange(reader *DBReader, ran kv.KeyRange) error {
+	seekKey := ran.StartKey
+	for {
+		if e.done() {
+			return nil
+		}
+		var lastKey []byte
+		var scanErr error
+		err := reader.Scan(seekKey, ran.EndKey, scanLimit, e.startTS, func(key, value []byte) error {
+			if e.done() {
+				return nil
+			}
+			lastKey = key
+			if err := e.processRow(key, safeCopy(value)); err != nil {
+				scanErr = err
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if scanErr != nil {
+			return errors.Trace(scanErr)
+		}
+		if lastKey == nil {
+			return nil
+		}
+		seekKey = []byte(kv.Key(lastKey).PrefixNext())
+	}
+}
@@ -0,0 +1,24 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClosureExecDone(t *testing.T) {
+	e := &closureExec{limit: -1}
+	require.False(t, e.done(), "no limit configured means never done")
+
+	e = &closureExec{limit: 2}
+	require.False(t, e.done())
+	e.rowCount = 2
+	require.True(t, e.done(), "rowCount reaching the configured limit must stop the scan")
+}
+
+func TestClosureExecMatchRowNoConditions(t *testing.T) {
+	e := &closureExec{}
+	matched, err := e.matchRow(nil)
+	require.NoError(t, err)
+	require.True(t, matched, "a closureExec with no pushed-down filter must match every row")
+}
@@ -0,0 +1,367 @@
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tipb/go-tipb"
+	"golang.org/x/net/context"
+)
+
+// evalContext carries the per-request pieces every executor that evaluates
+// pushed-down expressions needs: the pushed-down column types (for
+// expression.PBToExpr and decoding) and the statement context governing
+// truncate/overflow behavior. buildDAGContext derives one per request so
+// tryBuildClosureExecutor and buildExec share a single copy.
+type evalContext struct {
+	sc       *stmtctx.StatementContext
+	fieldTps []*types.FieldType
+}
+
+// decodeRelatedColumnVals decodes only the columns at relatedColOffsets out
+// of an encoded row into row; callers size row to len(fieldTps) up front and
+// only read back the offsets they asked to decode.
+func (ctx *evalContext) decodeRelatedColumnVals(relatedColOffsets []int, value [][]byte, row []types.Datum) error {
+	for _, offset := range relatedColOffsets {
+		if value[offset] == nil {
+			row[offset].SetNull()
+			continue
+		}
+		_, d, err := codec.DecodeOne(value[offset])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		row[offset] = d
+	}
+	return nil
+}
+
+// allColumnOffsets returns 0..len(columns)-1. It's the relatedColOffsets
+// hashAggExec/streamAggExec are built with: unlike a selectionExec's
+// expression.Expression conditions, an aggregation.Aggregation doesn't
+// expose an inspectable argument list for extractOffsetsInColumnInfo to
+// prune against, so they conservatively decode every pushed-down column.
+func allColumnOffsets(columns []*tipb.ColumnInfo) []int {
+	offsets := make([]int, len(columns))
+	for i := range columns {
+		offsets[i] = i
+	}
+	return offsets
+}
+
+// fieldTypeFromPBColumn converts a pushed-down column descriptor into the
+// types.FieldType the expression and codec packages operate on.
+func fieldTypeFromPBColumn(col *tipb.ColumnInfo) *types.FieldType {
+	ft := types.NewFieldType(byte(col.GetTp()))
+	ft.Flag = uint(col.GetFlag())
+	ft.Flen = int(col.GetColumnLen())
+	ft.Decimal = int(col.GetDecimal())
+	ft.Elems = col.Elems
+	return ft
+}
+
+// buildDAGContext derives the scan-node setup shared by
+// tryBuildClosureExecutor and buildExec from the incoming request: the
+// pushed-down column metadata, the decoded key ranges and the evalContext.
+// handleCopDAGRequest computes this once and passes it to whichever builder
+// ends up handling the plan.
+func buildDAGContext(req *coprocessor.Request, dagReq *tipb.DAGRequest) (*evalContext, map[int64]int, []*tipb.ColumnInfo, []kv.KeyRange, error) {
+	if len(dagReq.Executors) == 0 {
+		return nil, nil, nil, nil, errors.New("DAG request has no executors")
+	}
+	var columns []*tipb.ColumnInfo
+	switch dagReq.Executors[0].Tp {
+	case tipb.ExecType_TypeTableScan:
+		columns = dagReq.Executors[0].TblScan.Columns
+	case tipb.ExecType_TypeIndexScan:
+		columns = dagReq.Executors[0].IdxScan.Columns
+	default:
+		return nil, nil, nil, nil, errors.Errorf("buildDAGContext: unsupported leaf executor type %v", dagReq.Executors[0].Tp)
+	}
+	colIDs := make(map[int64]int, len(columns))
+	fieldTps := make([]*types.FieldType, 0, len(columns))
+	for i, col := range columns {
+		colIDs[col.GetColumnId()] = i
+		fieldTps = append(fieldTps, fieldTypeFromPBColumn(col))
+	}
+	evalCtx := &evalContext{sc: &stmtctx.StatementContext{}, fieldTps: fieldTps}
+	kvRanges := make([]kv.KeyRange, 0, len(req.GetRanges()))
+	for _, ran := range req.GetRanges() {
+		kvRanges = append(kvRanges, kv.KeyRange{StartKey: ran.GetStart(), EndKey: ran.GetEnd()})
+	}
+	return evalCtx, colIDs, columns, kvRanges, nil
+}
+
+// buildExec is the fallback handleCopDAGRequest takes when
+// tryBuildClosureExecutor declines the plan (topN, aggregation, or anything
+// past the fused fast path's whitelist): it builds the full generic
+// executor tree bottom-up from the leaf scan, using the same colIDs,
+// columns, kvRanges and evalCtx setup tryBuildClosureExecutor takes.
+func buildExec(reqCtx *requestCtx, dagReq *tipb.DAGRequest, evalCtx *evalContext, colIDs map[int64]int, columns []*tipb.ColumnInfo, kvRanges []kv.KeyRange) (executor, error) {
+	execs := dagReq.Executors
+	scan := execs[0]
+	var src executor
+	switch scan.Tp {
+	case tipb.ExecType_TypeTableScan:
+		src = &tableScanExec{
+			TableScan:      scan.TblScan,
+			colIDs:         colIDs,
+			kvRanges:       kvRanges,
+			startTS:        dagReq.GetStartTs(),
+			isolationLevel: reqCtx.isolationLevel,
+			mvccStore:      reqCtx.mvccStore,
+			reqCtx:         reqCtx,
+			ignoreLock:     reqCtx.ignoreLock,
+		}
+	case tipb.ExecType_TypeIndexScan:
+		pkStatus := pkColNotExists
+		for _, col := range columns {
+			if col.GetPkHandle() {
+				if mysql.HasUnsignedFlag(uint(col.GetFlag())) {
+					pkStatus = pkColIsUnsigned
+				} else {
+					pkStatus = pkColIsSigned
+				}
+			}
+		}
+		src = &indexScanExec{
+			IndexScan:      scan.IdxScan,
+			colsLen:        len(columns),
+			kvRanges:       kvRanges,
+			startTS:        dagReq.GetStartTs(),
+			isolationLevel: reqCtx.isolationLevel,
+			mvccStore:      reqCtx.mvccStore,
+			reqCtx:         reqCtx,
+			pkStatus:       pkStatus,
+			ignoreLock:     reqCtx.ignoreLock,
+		}
+	default:
+		return nil, errors.Errorf("buildExec: unsupported leaf executor type %v", scan.Tp)
+	}
+	for _, exec := range execs[1:] {
+		switch exec.Tp {
+		case tipb.ExecType_TypeSelection:
+			conditions, err := convertToExprs(evalCtx.sc, evalCtx.fieldTps, exec.Selection.Conditions)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			offsets, err := extractOffsetsInColumnInfo(columns, conditions)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			src = &selectionExec{
+				conditions:        conditions,
+				relatedColOffsets: offsets,
+				row:               make([]types.Datum, len(columns)),
+				evalCtx:           evalCtx,
+				src:               src,
+			}
+		case tipb.ExecType_TypeAggregation, tipb.ExecType_TypeStreamAgg:
+			aggExprs, err := buildAggExprs(evalCtx, exec.Aggregation.AggFunc)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			groupByExprs, err := convertToExprs(evalCtx.sc, evalCtx.fieldTps, exec.Aggregation.GroupBy)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			relatedColOffsets := allColumnOffsets(columns)
+			row := make([]types.Datum, len(columns))
+			if exec.Tp == tipb.ExecType_TypeStreamAgg {
+				src = &streamAggExec{
+					evalCtx:           evalCtx,
+					aggExprs:          aggExprs,
+					groupByExprs:      groupByExprs,
+					relatedColOffsets: relatedColOffsets,
+					row:               row,
+					src:               src,
+				}
+			} else {
+				src = &hashAggExec{
+					evalCtx:           evalCtx,
+					aggExprs:          aggExprs,
+					groupByExprs:      groupByExprs,
+					relatedColOffsets: relatedColOffsets,
+					row:               row,
+					src:               src,
+				}
+			}
+		case tipb.ExecType_TypeLimit:
+			src = &limitExec{limit: exec.Limit.GetLimit(), src: src}
+		case tipb.ExecType_TypeTopN:
+			topN := exec.TopN
+			orderByItems := make([]*tipb.Expr, len(topN.OrderBy))
+			descs := make([]bool, len(topN.OrderBy))
+			for i, item := range topN.OrderBy {
+				orderByItems[i] = item.Expr
+				descs[i] = item.GetDesc()
+			}
+			orderByExprs, err := convertToExprs(evalCtx.sc, evalCtx.fieldTps, orderByItems)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			relatedColOffsets, err := extractOffsetsInColumnInfo(columns, orderByExprs)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			src = &topNExec{
+				heap:              newTopNHeap(int(topN.GetLimit()), descs),
+				evalCtx:           evalCtx,
+				relatedColOffsets: relatedColOffsets,
+				orderByExprs:      orderByExprs,
+				row:               make([]types.Datum, len(columns)),
+				src:               src,
+			}
+		default:
+			return nil, errors.Errorf("buildExec: unsupported executor type %v", exec.Tp)
+		}
+	}
+	return src, nil
+}
+
+// rowsPerChunk bounds how many rows handleCopDAGRequest packs into a single
+// tipb.Chunk of the row-oriented response format.
+const rowsPerChunk = 64
+
+// runExec drains exec via Next() and packs the resulting rows into
+// tipb.Chunk.RowsData the row-oriented way: columns are already individually
+// codec.EncodeValue-encoded and therefore self-delimiting, so appending them
+// in order is all concatenation needs to do.
+func runExec(exec executor) (*coprocessor.Response, error) {
+	selResp := &tipb.SelectResponse{}
+	ctx := context.Background()
+	rowCount := 0
+	for {
+		row, err := exec.Next(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if row == nil {
+			break
+		}
+		if rowCount%rowsPerChunk == 0 {
+			selResp.Chunks = append(selResp.Chunks, tipb.Chunk{})
+		}
+		cur := &selResp.Chunks[len(selResp.Chunks)-1]
+		for _, col := range row {
+			cur.RowsData = append(cur.RowsData, col...)
+		}
+		rowCount++
+	}
+	return marshalSelectResponse(selResp)
+}
+
+// runExecBatch drains exec via NextBatch() instead of Next(), serializing
+// each chunkMaxRows-sized chunk.Chunk with chunk.Codec rather than falling
+// back to the row-at-a-time [][]byte path runExec uses. handleCopDAGRequest
+// picks this over runExec when the client's DAGRequest.EncodeType advertises
+// chunk encoding.
+func runExecBatch(exec executor, evalCtx *evalContext) (*coprocessor.Response, error) {
+	selResp := &tipb.SelectResponse{EncodeType: tipb.EncodeType_TypeChunk}
+	codec := chunk.Codec{}
+	ctx := context.Background()
+	for {
+		chk := chunk.NewChunkWithCapacity(evalCtx.fieldTps, chunkMaxRows)
+		if err := exec.NextBatch(ctx, chk); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if chk.NumRows() == 0 {
+			break
+		}
+		selResp.Chunks = append(selResp.Chunks, tipb.Chunk{RowsData: codec.Encode(chk)})
+	}
+	return marshalSelectResponse(selResp)
+}
+
+// marshalSelectResponse wraps a finished tipb.SelectResponse into the
+// coprocessor.Response envelope that goes back over the wire.
+func marshalSelectResponse(selResp *tipb.SelectResponse) (*coprocessor.Response, error) {
+	data, err := selResp.Marshal()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &coprocessor.Response{Data: data}, nil
+}
+
+// runClosureExec drains the fused fast path and serializes the result the
+// same way handleCopDAGRequest's generic path picks between runExecBatch
+// and runExec: chunk-encoded with chunk.Codec when the client asked for
+// EncodeType_TypeChunk (closure.encodeType, set from dagReq.GetEncodeType()
+// by tryBuildClosureExecutor), row-oriented RowsData otherwise.
+func runClosureExec(closure *closureExec) (*coprocessor.Response, error) {
+	if closure.encodeType == tipb.EncodeType_TypeChunk {
+		chk := chunk.NewChunkWithCapacity(closure.evalCtx.fieldTps, chunkMaxRows)
+		if err := closure.process(chk); err != nil {
+			return nil, errors.Trace(err)
+		}
+		codec := chunk.Codec{}
+		selResp := &tipb.SelectResponse{
+			EncodeType: tipb.EncodeType_TypeChunk,
+			Chunks:     []tipb.Chunk{{RowsData: codec.Encode(chk)}},
+		}
+		return marshalSelectResponse(selResp)
+	}
+	if err := closure.process(nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+	selResp := &tipb.SelectResponse{}
+	for i, row := range closure.rows {
+		if i%rowsPerChunk == 0 {
+			selResp.Chunks = append(selResp.Chunks, tipb.Chunk{})
+		}
+		cur := &selResp.Chunks[len(selResp.Chunks)-1]
+		for _, col := range row {
+			cur.RowsData = append(cur.RowsData, col...)
+		}
+	}
+	return marshalSelectResponse(selResp)
+}
+
+// handleCopDAGRequest is the coprocessor entry point for tipb.DAGRequest
+// requests: it derives the scan-node setup once, tries the fused closure
+// fast path first, and falls back to the generic executor tree via
+// buildExec when the plan isn't one of closureExec's whitelisted shapes.
+func handleCopDAGRequest(reqCtx *requestCtx, req *coprocessor.Request, dagReq *tipb.DAGRequest) (*coprocessor.Response, error) {
+	evalCtx, colIDs, columns, kvRanges, err := buildDAGContext(req, dagReq)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	closure, err := tryBuildClosureExecutor(reqCtx, dagReq, evalCtx, colIDs, columns, kvRanges)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if closure != nil {
+		return runClosureExec(closure)
+	}
+	exec, err := buildExec(reqCtx, dagReq, evalCtx, colIDs, columns, kvRanges)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if dagReq.GetEncodeType() == tipb.EncodeType_TypeChunk {
+		return runExecBatch(exec, evalCtx)
+	}
+	return runExec(exec)
+}
+
+// handleCopRequest is the top-level coprocessor dispatch entry point: it
+// looks at the request's Tp to decide whether it's a tipb.DAGRequest or a
+// changeScanExec request and routes it accordingly.
+func handleCopRequest(reqCtx *requestCtx, req *coprocessor.Request) (*coprocessor.Response, error) {
+	switch req.GetTp() {
+	case kv.ReqTypeDAG:
+		dagReq := new(tipb.DAGRequest)
+		if err := dagReq.Unmarshal(req.GetData()); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return handleCopDAGRequest(reqCtx, req, dagReq)
+	case reqTypeChangeScan:
+		return handleChangeScanRequest(reqCtx, req)
+	default:
+		return nil, errors.Errorf("handleCopRequest: unsupported request type %d", req.GetTp())
+	}
+}